@@ -0,0 +1,93 @@
+// ovirt-imageio
+// Copyright (C) 2021 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qemuimg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConvertArgs(t *testing.T) {
+	cases := []struct {
+		name     string
+		src, dst ImageLocation
+		opts     ConvertOptions
+		progress bool
+		want     []string
+	}{
+		{
+			name: "local to local, no options",
+			src:  LocalFile("/var/tmp/src.img"),
+			dst:  LocalFile("/var/tmp/dst.img"),
+			want: []string{"convert", "/var/tmp/src.img", "/var/tmp/dst.img"},
+		},
+		{
+			name:     "format, target format, sparse size, compressed, progress",
+			src:      LocalFile("/var/tmp/src.img"),
+			dst:      LocalFile("/var/tmp/dst.img"),
+			opts:     ConvertOptions{Format: "raw", TargetFormat: "qcow2", SparseSize: "64k", Compressed: true},
+			progress: true,
+			want: []string{
+				"convert", "-p", "-c", "-f", "raw", "-O", "qcow2", "-S", "64k",
+				"/var/tmp/src.img", "/var/tmp/dst.img",
+			},
+		},
+		{
+			name: "backing file and subformat become a single -o",
+			src:  LocalFile("/var/tmp/src.img"),
+			dst:  LocalFile("/var/tmp/dst.img"),
+			opts: ConvertOptions{BackingFile: "/var/tmp/base.qcow2", SubFormat: "streamOptimized"},
+			want: []string{
+				"convert",
+				"-o", "backing_file=/var/tmp/base.qcow2,subformat=streamOptimized",
+				"/var/tmp/src.img", "/var/tmp/dst.img",
+			},
+		},
+		{
+			name: "backing file with a comma is escaped in -o",
+			src:  LocalFile("/var/tmp/src.img"),
+			dst:  LocalFile("/var/tmp/dst.img"),
+			opts: ConvertOptions{BackingFile: "/var/tmp/base,subformat=evil.qcow2"},
+			want: []string{
+				"convert",
+				"-o", "backing_file=/var/tmp/base,,subformat=evil.qcow2",
+				"/var/tmp/src.img", "/var/tmp/dst.img",
+			},
+		},
+		{
+			name: "nbd source and target use --image-opts/--target-image-opts",
+			src:  NBDSource("nbd://host:6666/export"),
+			dst:  NBDTarget("nbd+unix:///export?socket=/tmp/sock"),
+			want: []string{
+				"convert",
+				"--image-opts", "driver=nbd,server.type=inet,server.host=host,server.port=6666,export=export",
+				"--target-image-opts", "driver=nbd,server.type=unix,server.path=/tmp/sock,export=export",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := convertArgs(c.src, c.dst, c.opts, c.progress)
+			if err != nil {
+				t.Fatalf("convertArgs: unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("convertArgs() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestConvertArgsInvalidNBDURI(t *testing.T) {
+	_, err := convertArgs(NBDSource("nbd:///export"), LocalFile("/var/tmp/dst.img"), ConvertOptions{}, false)
+	if err == nil {
+		t.Fatal("expected an error for an NBD source missing a host, got nil")
+	}
+}
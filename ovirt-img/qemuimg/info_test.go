@@ -0,0 +1,77 @@
+// ovirt-imageio
+// Copyright (C) 2021 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qemuimg
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestImageInfoDecoding(t *testing.T) {
+	const fixture = `{
+		"format": "qcow2",
+		"virtual-size": 10737418240,
+		"backing-filename": "/var/tmp/base.qcow2",
+		"backing-filename-format": "qcow2",
+		"actual-size": 393216,
+		"dirty-flag": false,
+		"cluster-size": 65536,
+		"snapshots": [
+			{"id": "1", "name": "before-upgrade", "vm-state-size": 0, "date-sec": 1700000000, "date-nsec": 0}
+		]
+	}`
+
+	var info ImageInfo
+	if err := json.Unmarshal([]byte(fixture), &info); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	want := ImageInfo{
+		Format:            "qcow2",
+		Size:              10737418240,
+		BackingFile:       "/var/tmp/base.qcow2",
+		BackingFileFormat: "qcow2",
+		ActualSize:        393216,
+		ClusterSize:       65536,
+		Snapshots: []SnapshotInfo{
+			{ID: "1", Name: "before-upgrade", DateSec: 1700000000},
+		},
+	}
+
+	if info.Format != want.Format || info.Size != want.Size || info.BackingFile != want.BackingFile ||
+		info.BackingFileFormat != want.BackingFileFormat || info.ActualSize != want.ActualSize ||
+		info.DirtyFlag != want.DirtyFlag || info.ClusterSize != want.ClusterSize {
+		t.Fatalf("got %+v, want %+v", info, want)
+	}
+	if len(info.Snapshots) != 1 || info.Snapshots[0] != want.Snapshots[0] {
+		t.Fatalf("got snapshots %+v, want %+v", info.Snapshots, want.Snapshots)
+	}
+}
+
+func TestInfoChainDecodingPreservesOrder(t *testing.T) {
+	const fixture = `[
+		{"format": "qcow2", "virtual-size": 10737418240, "backing-filename": "base.qcow2"},
+		{"format": "qcow2", "virtual-size": 10737418240}
+	]`
+
+	var chain []*ImageInfo
+	if err := json.Unmarshal([]byte(fixture), &chain); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	if len(chain) != 2 {
+		t.Fatalf("got %d images in chain, want 2", len(chain))
+	}
+	if chain[0].BackingFile != "base.qcow2" {
+		t.Fatalf("expected the top image (index 0) to carry the backing file, got %+v", chain[0])
+	}
+	if chain[1].BackingFile != "" {
+		t.Fatalf("expected the base image (index 1) to have no backing file, got %+v", chain[1])
+	}
+}
@@ -0,0 +1,91 @@
+// ovirt-imageio
+// Copyright (C) 2021 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qemuimg
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMeasureInfoDecoding(t *testing.T) {
+	const fixture = `{"required": 1073741824, "fully-allocated": 4294967296, "bitmaps": 65536}`
+
+	var info MeasureInfo
+	if err := json.Unmarshal([]byte(fixture), &info); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	want := MeasureInfo{RequiredSize: 1073741824, FullyAllocatedSize: 4294967296, BitmapsSize: 65536}
+	if info != want {
+		t.Fatalf("got %+v, want %+v", info, want)
+	}
+}
+
+func TestCheckResultDecoding(t *testing.T) {
+	const fixture = `{
+		"corruptions": 1,
+		"leaks": 2,
+		"corruptions-fixed": 0,
+		"leaks-fixed": 0,
+		"image-end-offset": 68719476736,
+		"total-clusters": 16384,
+		"allocated-clusters": 8192,
+		"fragmented-clusters": 3,
+		"compressed-clusters": 0,
+		"check-errors": 0
+	}`
+
+	var result CheckResult
+	if err := json.Unmarshal([]byte(fixture), &result); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	want := CheckResult{
+		Corruptions:        1,
+		Leaks:              2,
+		ImageEndOffset:     68719476736,
+		TotalClusters:      16384,
+		AllocatedClusters:  8192,
+		FragmentedClusters: 3,
+	}
+	if result != want {
+		t.Fatalf("got %+v, want %+v", result, want)
+	}
+}
+
+func TestMeasureArgs(t *testing.T) {
+	cases := []struct {
+		name         string
+		filename     string
+		targetFormat string
+		want         []string
+	}{
+		{
+			name:     "no target format",
+			filename: "/var/tmp/disk.img",
+			want:     []string{"measure", "--output", "json", "/var/tmp/disk.img"},
+		},
+		{
+			name:         "with target format",
+			filename:     "/var/tmp/disk.img",
+			targetFormat: "qcow2",
+			want:         []string{"measure", "--output", "json", "-O", "qcow2", "/var/tmp/disk.img"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := measureArgs(c.filename, c.targetFormat)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("measureArgs(%q, %q) = %q, want %q", c.filename, c.targetFormat, got, c.want)
+			}
+		})
+	}
+}
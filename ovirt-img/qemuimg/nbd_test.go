@@ -0,0 +1,74 @@
+// ovirt-imageio
+// Copyright (C) 2021 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qemuimg
+
+import "testing"
+
+func TestNBDImageOpts(t *testing.T) {
+	cases := []struct {
+		name    string
+		uri     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "inet with port and export",
+			uri:  "nbd://host:6666/export",
+			want: "driver=nbd,server.type=inet,server.host=host,server.port=6666,export=export",
+		},
+		{
+			name: "inet without port defaults to 10809",
+			uri:  "nbd://host/export",
+			want: "driver=nbd,server.type=inet,server.host=host,server.port=10809,export=export",
+		},
+		{
+			name: "inet without export",
+			uri:  "nbd://host:6666",
+			want: "driver=nbd,server.type=inet,server.host=host,server.port=6666",
+		},
+		{
+			name:    "inet missing host",
+			uri:     "nbd:///export",
+			wantErr: true,
+		},
+		{
+			name: "unix with socket and export",
+			uri:  "nbd+unix:///export?socket=/var/run/vdsm/nbd.sock",
+			want: "driver=nbd,server.type=unix,server.path=/var/run/vdsm/nbd.sock,export=export",
+		},
+		{
+			name:    "unix missing socket",
+			uri:     "nbd+unix:///export",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported scheme",
+			uri:     "http://host/export",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := nbdImageOpts(c.uri)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("nbdImageOpts(%q) = %q, want error", c.uri, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("nbdImageOpts(%q) unexpected error: %v", c.uri, err)
+			}
+			if got != c.want {
+				t.Fatalf("nbdImageOpts(%q) = %q, want %q", c.uri, got, c.want)
+			}
+		})
+	}
+}
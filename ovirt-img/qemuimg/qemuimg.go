@@ -9,18 +9,62 @@
 package qemuimg
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/url"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type ImageInfo struct {
 	Format string `json:"format"`
 	Size   uint64 `json:"virtual-size"`
+
+	// BackingFile is the path of this image's backing file, if any.
+	BackingFile string `json:"backing-filename,omitempty"`
+
+	// BackingFileFormat is the format of BackingFile.
+	BackingFileFormat string `json:"backing-filename-format,omitempty"`
+
+	// ActualSize is the number of bytes actually allocated on disk.
+	ActualSize uint64 `json:"actual-size"`
+
+	// DirtyFlag reports whether the image was left in an inconsistent
+	// state, e.g. after a crash during a write.
+	DirtyFlag bool `json:"dirty-flag"`
+
+	// ClusterSize is the format's cluster size, in bytes.
+	ClusterSize uint64 `json:"cluster-size,omitempty"`
+
+	// Snapshots lists the internal snapshots stored in the image, if
+	// any.
+	Snapshots []SnapshotInfo `json:"snapshots,omitempty"`
+}
+
+// SnapshotInfo describes a single internal snapshot of an image, as
+// returned by "qemu-img info --output json".
+type SnapshotInfo struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	VMSize   uint64 `json:"vm-state-size"`
+	DateSec  int64  `json:"date-sec"`
+	DateNSec int64  `json:"date-nsec"`
 }
 
-func Info(filename string) (*ImageInfo, error) {
-	out, err := run("qemu-img", "info", "--output", "json", filename)
+func Info(ctx context.Context, filename string) (*ImageInfo, error) {
+	if err := validatePath(filename, false); err != nil {
+		return nil, err
+	}
+
+	out, err := run(ctx, "qemu-img", "info", "--output", "json", filename)
 	if err != nil {
 		return nil, err
 	}
@@ -33,24 +77,668 @@ func Info(filename string) (*ImageInfo, error) {
 	return &info, nil
 }
 
-func run(name string, arg ...string) ([]byte, error) {
-	cmd := exec.Command(name, arg...)
+// InfoChain walks the backing chain of filename, returning an ImageInfo
+// for filename itself followed by one for each of its ancestors, in
+// order. It wraps "qemu-img info --backing-chain".
+func InfoChain(ctx context.Context, filename string) ([]*ImageInfo, error) {
+	if err := validatePath(filename, false); err != nil {
+		return nil, err
+	}
+
+	out, err := run(ctx, "qemu-img", "info", "--backing-chain", "--output", "json", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*ImageInfo
+	if err = json.Unmarshal(out, &chain); err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// MeasureInfo reports the storage a conversion or creation is expected to
+// require, as returned by "qemu-img measure --output json".
+type MeasureInfo struct {
+	// RequiredSize is the number of bytes required to create the image.
+	RequiredSize uint64 `json:"required"`
+
+	// FullyAllocatedSize is the number of bytes required if the image
+	// were fully allocated.
+	FullyAllocatedSize uint64 `json:"fully-allocated"`
+
+	// BitmapsSize is the number of bytes required by persistent bitmaps,
+	// included in RequiredSize and FullyAllocatedSize.
+	BitmapsSize uint64 `json:"bitmaps"`
+}
+
+// Measure estimates the storage required to convert filename to
+// targetFormat, without performing the conversion. targetFormat may be
+// empty, in which case qemu-img measures against filename's own format.
+// It wraps "qemu-img measure".
+func Measure(ctx context.Context, filename, targetFormat string) (*MeasureInfo, error) {
+	if err := validatePath(filename, false); err != nil {
+		return nil, err
+	}
+
+	out, err := run(ctx, "qemu-img", measureArgs(filename, targetFormat)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var info MeasureInfo
+	if err = json.Unmarshal(out, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// measureArgs builds the "qemu-img measure" argument list for filename
+// and targetFormat, without running anything.
+func measureArgs(filename, targetFormat string) []string {
+	args := []string{"measure", "--output", "json"}
+	if targetFormat != "" {
+		args = append(args, "-O", targetFormat)
+	}
+	return append(args, filename)
+}
+
+// CheckResult reports the consistency of an image, as returned by
+// "qemu-img check --output json".
+type CheckResult struct {
+	// Corruptions is the number of corruptions found.
+	Corruptions int64 `json:"corruptions"`
+
+	// Leaks is the number of leaked clusters found.
+	Leaks int64 `json:"leaks"`
+
+	// CorruptionsFixed is the number of corruptions repaired. qemu-img
+	// reports it only when repairing; Check does not request a repair,
+	// so Check leaves it zero.
+	CorruptionsFixed int64 `json:"corruptions-fixed,omitempty"`
+
+	// LeaksFixed is the number of leaks repaired. qemu-img reports it
+	// only when repairing; Check does not request a repair, so Check
+	// leaves it zero.
+	LeaksFixed int64 `json:"leaks-fixed,omitempty"`
+
+	// ImageEndOffset is the offset right after the last allocated byte
+	// of the file.
+	ImageEndOffset uint64 `json:"image-end-offset"`
+
+	// TotalClusters is the total number of clusters in the image.
+	TotalClusters int64 `json:"total-clusters"`
+
+	// AllocatedClusters is the number of allocated clusters.
+	AllocatedClusters int64 `json:"allocated-clusters"`
+
+	// FragmentedClusters is the number of fragmented clusters.
+	FragmentedClusters int64 `json:"fragmented-clusters"`
+
+	// CompressedClusters is the number of compressed clusters.
+	CompressedClusters int64 `json:"compressed-clusters"`
+
+	// CheckErrors is the number of errors that occurred during the
+	// check and could not be fixed.
+	CheckErrors int64 `json:"check-errors"`
+}
+
+// Check validates the consistency of filename. It wraps "qemu-img check".
+func Check(ctx context.Context, filename string) (*CheckResult, error) {
+	if err := validatePath(filename, false); err != nil {
+		return nil, err
+	}
+
+	out, err := run(ctx, "qemu-img", "check", "--output", "json", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var result CheckResult
+	if err = json.Unmarshal(out, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// validatePath rejects path values that could be reinterpreted by
+// qemu-img as something other than a plain local file: an argument
+// starting with "-" could be parsed as a flag, and a "://" substring
+// could select one of qemu-img's remote protocol drivers. Callers that
+// intentionally pass a protocol string through a plain string field
+// that has no typed way to opt in (e.g. ConvertOptions.BackingFile,
+// unlike src/dst, which use the typed ImageLocation) must set
+// allowProtocol to opt in.
+func validatePath(path string, allowProtocol bool) error {
+	if strings.HasPrefix(path, "-") {
+		return fmt.Errorf("qemuimg: invalid path %q: must not start with '-'", path)
+	}
+	if !allowProtocol && strings.Contains(path, "://") {
+		return fmt.Errorf("qemuimg: invalid path %q: protocol strings are not allowed unless opted in", path)
+	}
+	return nil
+}
+
+// escapeOptValue doubles any comma in v, so it round-trips through a
+// qemu-img comma-separated "key=val,key=val" option list (the
+// convention shared by -o and --image-opts) as a literal character of
+// the value instead of being parsed as a separator between options. A
+// caller-supplied value such as BackingFile, SubFormat, or an NBD URI's
+// host/export/socket would otherwise let a comma smuggle in extra
+// suboptions.
+func escapeOptValue(v string) string {
+	return strings.ReplaceAll(v, ",", ",,")
+}
+
+// defaultNBDPort is the standard NBD port, used when an "nbd://" URI
+// omits one.
+const defaultNBDPort = "10809"
+
+// nbdImageOpts translates an "nbd://host:port/export" or
+// "nbd+unix:///export?socket=/path/to.sock" URI into a qemu-img
+// --image-opts string selecting the nbd driver, so Convert and Create can
+// operate directly against a qemu-nbd endpoint instead of staging through
+// a local file.
+func nbdImageOpts(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("qemuimg: invalid NBD URI %q: %v", uri, err)
+	}
+
+	export := escapeOptValue(strings.TrimPrefix(u.Path, "/"))
+
+	switch u.Scheme {
+	case "nbd":
+		if u.Hostname() == "" {
+			return "", fmt.Errorf("qemuimg: NBD URI %q is missing a host", uri)
+		}
+		port := u.Port()
+		if port == "" {
+			port = defaultNBDPort
+		}
+		opts := fmt.Sprintf("driver=nbd,server.type=inet,server.host=%s,server.port=%s", escapeOptValue(u.Hostname()), port)
+		if export != "" {
+			opts += ",export=" + export
+		}
+		return opts, nil
+	case "nbd+unix":
+		socket := u.Query().Get("socket")
+		if socket == "" {
+			return "", fmt.Errorf("qemuimg: NBD URI %q is missing a socket query parameter", uri)
+		}
+		opts := fmt.Sprintf("driver=nbd,server.type=unix,server.path=%s", escapeOptValue(socket))
+		if export != "" {
+			opts += ",export=" + export
+		}
+		return opts, nil
+	default:
+		return "", fmt.Errorf("qemuimg: unsupported NBD URI scheme %q", u.Scheme)
+	}
+}
+
+// ImageLocation names an image that Convert or Create reads from or
+// writes to: either a local file or a qemu-nbd export. Construct one
+// with LocalFile, NBDSource, or NBDTarget; the zero value is not valid.
+type ImageLocation struct {
+	path string
+	nbd  bool
+}
+
+// LocalFile names a local file path.
+func LocalFile(path string) ImageLocation {
+	return ImageLocation{path: path}
+}
+
+// NBDSource names a qemu-nbd export ("nbd://host:port/export" or
+// "nbd+unix:///export?socket=/path/to.sock") that Convert reads its
+// source image from, instead of a local file, letting the conversion
+// read directly from an NBD endpoint without staging to disk.
+func NBDSource(uri string) ImageLocation {
+	return ImageLocation{path: uri, nbd: true}
+}
+
+// NBDTarget names a qemu-nbd export that Convert or Create writes its
+// output image to, instead of a local file.
+func NBDTarget(uri string) ImageLocation {
+	return ImageLocation{path: uri, nbd: true}
+}
 
-	stdout, err := cmd.Output()
+// validate rejects a local path that looks like a flag or a protocol
+// string. An NBDSource/NBDTarget is always valid here: naming one is an
+// explicit, typed choice by the caller rather than something sniffed
+// out of a plain string.
+func (l ImageLocation) validate(allowProtocol bool) error {
+	if l.nbd {
+		return nil
+	}
+	return validatePath(l.path, allowProtocol)
+}
 
+// args returns the qemu-img argument(s) that select l as an input or
+// output image: the path itself for a local file, or optsFlag followed
+// by an --image-opts style options string for an NBD endpoint.
+func (l ImageLocation) args(optsFlag string) ([]string, error) {
+	if !l.nbd {
+		return []string{l.path}, nil
+	}
+
+	opts, err := nbdImageOpts(l.path)
 	if err != nil {
-		var stderr []byte
-		if ee, ok := err.(*exec.ExitError); ok {
-			stderr = ee.Stderr
+		return nil, err
+	}
+
+	return []string{optsFlag, opts}, nil
+}
+
+// ConvertOptions configures a qemu-img convert invocation.
+type ConvertOptions struct {
+	// Format is the source image format (-f). Optional; qemu-img probes
+	// the format when empty.
+	Format string
+
+	// TargetFormat is the destination image format (-O), e.g. "raw",
+	// "qcow2", "vmdk", "vhdx".
+	TargetFormat string
+
+	// SubFormat selects a format-specific subformat via -o subformat=,
+	// e.g. "streamOptimized" for vmdk.
+	SubFormat string
+
+	// BackingFile sets the backing file of the target image via
+	// -o backing_file=.
+	BackingFile string
+
+	// SparseSize is passed as -S and controls the minimum size of a
+	// contiguous zero area that is left as a sparse hole in the target.
+	SparseSize string
+
+	// Compressed enables target compression (-c).
+	Compressed bool
+
+	// Progress enables qemu-img's -p progress output.
+	Progress bool
+
+	// AllowRemotePaths allows BackingFile to be a protocol string (e.g.
+	// an NBD URI) rather than a local path. Use NBDSource/NBDTarget to
+	// pass a remote endpoint as src or dst themselves.
+	AllowRemotePaths bool
+}
+
+// Convert converts src into dst, using opts to select the target format
+// and any format specific options. It wraps "qemu-img convert". src and
+// dst are typically LocalFile, but may be an NBDSource/NBDTarget naming
+// a qemu-nbd export instead, letting the conversion read from or write
+// directly to an NBD endpoint without staging to disk.
+//
+// ctx may be used to cancel or time out a running conversion. If progress
+// is non-nil, Convert sends a Progress update on it every time qemu-img
+// reports one; the channel is never closed by Convert. Sends are
+// best-effort: if ctx is canceled while a send would block, the update is
+// dropped.
+func Convert(ctx context.Context, src, dst ImageLocation, opts ConvertOptions, progress chan<- Progress) error {
+	if err := src.validate(false); err != nil {
+		return err
+	}
+	if err := dst.validate(false); err != nil {
+		return err
+	}
+	if opts.BackingFile != "" {
+		if err := validatePath(opts.BackingFile, opts.AllowRemotePaths); err != nil {
+			return err
 		}
-		return stdout, fmt.Errorf(
+	}
+
+	args, err := convertArgs(src, dst, opts, opts.Progress || progress != nil)
+	if err != nil {
+		return err
+	}
+
+	var total uint64
+	if !src.nbd {
+		if info, err := Info(ctx, src.path); err == nil {
+			total = info.Size
+		}
+	}
+
+	_, err = runStreaming(ctx, progress, total, "qemu-img", args...)
+	return err
+}
+
+// convertArgs builds the "qemu-img convert" argument list for src, dst,
+// and opts, without running anything. progress reports whether -p
+// should be passed, since that also depends on whether Convert's caller
+// supplied a progress channel.
+func convertArgs(src, dst ImageLocation, opts ConvertOptions, progress bool) ([]string, error) {
+	args := []string{"convert"}
+
+	if progress {
+		args = append(args, "-p")
+	}
+	if opts.Compressed {
+		args = append(args, "-c")
+	}
+	if opts.Format != "" {
+		args = append(args, "-f", opts.Format)
+	}
+	if opts.TargetFormat != "" {
+		args = append(args, "-O", opts.TargetFormat)
+	}
+	if opts.SparseSize != "" {
+		args = append(args, "-S", opts.SparseSize)
+	}
+
+	var o []string
+	if opts.BackingFile != "" {
+		o = append(o, fmt.Sprintf("backing_file=%s", escapeOptValue(opts.BackingFile)))
+	}
+	if opts.SubFormat != "" {
+		o = append(o, fmt.Sprintf("subformat=%s", escapeOptValue(opts.SubFormat)))
+	}
+	if len(o) > 0 {
+		args = append(args, "-o", strings.Join(o, ","))
+	}
+
+	srcArgs, err := src.args("--image-opts")
+	if err != nil {
+		return nil, err
+	}
+	dstArgs, err := dst.args("--target-image-opts")
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, srcArgs...)
+	args = append(args, dstArgs...)
+
+	return args, nil
+}
+
+// CreateOptions configures a qemu-img create invocation.
+type CreateOptions struct {
+	// Format is the image format (-f), e.g. "raw", "qcow2". Optional;
+	// qemu-img defaults to raw when empty.
+	Format string
+
+	// BackingFile sets the backing file of the new image (-b).
+	BackingFile string
+
+	// Progress enables qemu-img's -p progress output.
+	Progress bool
+
+	// AllowRemotePaths allows BackingFile to be a protocol string (e.g.
+	// an NBD URI) rather than a local path. Use NBDTarget to pass a
+	// remote endpoint as filename itself.
+	AllowRemotePaths bool
+}
+
+// Create creates a new image at filename with the given virtual size, in
+// bytes. It wraps "qemu-img create". filename is typically LocalFile,
+// but may be an NBDTarget naming a qemu-nbd export instead of a local
+// file path.
+//
+// ctx and progress behave as described on Convert.
+func Create(ctx context.Context, filename ImageLocation, size uint64, opts CreateOptions, progress chan<- Progress) error {
+	if err := filename.validate(false); err != nil {
+		return err
+	}
+	if opts.BackingFile != "" {
+		if err := validatePath(opts.BackingFile, opts.AllowRemotePaths); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"create"}
+
+	opts.Progress = opts.Progress || progress != nil
+	if opts.Progress {
+		args = append(args, "-p")
+	}
+	if opts.Format != "" {
+		args = append(args, "-f", opts.Format)
+	}
+	if opts.BackingFile != "" {
+		args = append(args, "-b", opts.BackingFile)
+	}
+
+	fileArgs, err := filename.args("--image-opts")
+	if err != nil {
+		return err
+	}
+	args = append(args, fileArgs...)
+	args = append(args, strconv.FormatUint(size, 10))
+
+	_, err = runStreaming(ctx, progress, size, "qemu-img", args...)
+	return err
+}
+
+// Progress reports the completion state of a running qemu-img operation,
+// as parsed from its -p progress output.
+type Progress struct {
+	Percent    float64
+	BytesDone  uint64
+	BytesTotal uint64
+}
+
+// progressRe matches the "(NN.NN/100%)" fragments that qemu-img -p writes
+// to stdout as the operation advances.
+var progressRe = regexp.MustCompile(`\((\d+(?:\.\d+)?)/100%\)`)
+
+// defaultMaxOutputBytes bounds how much of a qemu-img process's stdout and
+// stderr is kept in memory when no explicit Limits.MaxOutputBytes is set,
+// so a runaway process cannot exhaust memory by flooding its output.
+const defaultMaxOutputBytes = 64 * 1024 * 1024
+
+// Limits configures resource constraints applied to every qemu-img
+// process started through this package. The zero value applies no
+// confinement beyond the default output cap.
+type Limits struct {
+	// MemoryMB caps the resident memory available to the qemu-img
+	// process, in megabytes. Enforced via a transient systemd-run
+	// scope; zero means unconfined.
+	MemoryMB int
+
+	// CPUPercent caps CPU usage as a percentage of one core, e.g. 200
+	// for two cores' worth. Enforced via a transient systemd-run scope;
+	// zero means unconfined.
+	CPUPercent int
+
+	// MaxOutputBytes caps how much of a process's stdout and stderr is
+	// retained; bytes beyond the cap are discarded without aborting the
+	// command. Zero uses defaultMaxOutputBytes.
+	MaxOutputBytes int64
+}
+
+var (
+	limitsMu sync.RWMutex
+	limits   Limits
+)
+
+// SetLimits installs the resource limits applied to every qemu-img
+// process subsequently started through this package. It is meant to be
+// called once, e.g. during daemon startup, before any conversions of
+// operator-supplied images are run.
+func SetLimits(l Limits) {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	limits = l
+}
+
+func currentLimits() Limits {
+	limitsMu.RLock()
+	defer limitsMu.RUnlock()
+	return limits
+}
+
+func maxOutputBytes(l Limits) int64 {
+	if l.MaxOutputBytes > 0 {
+		return l.MaxOutputBytes
+	}
+	return defaultMaxOutputBytes
+}
+
+// waitDelay bounds how long Wait waits for a command's stdout/stderr
+// pipes to reach EOF after the process has exited or ctx has canceled
+// it. Without it, a qemu-img that forks a child inheriting those pipes
+// can hang Wait forever even though qemu-img itself is long dead: Wait
+// also waits for the goroutines copying those pipes, and they only
+// return once every holder of the write end has closed it.
+const waitDelay = 10 * time.Second
+
+// buildCommand prepares name/arg to run under ctx, wrapping it in a
+// confined "systemd-run --scope" when Limits asks for memory or CPU
+// confinement.
+func buildCommand(ctx context.Context, l Limits, name string, arg []string) *exec.Cmd {
+	var cmd *exec.Cmd
+
+	if l.MemoryMB <= 0 && l.CPUPercent <= 0 {
+		cmd = exec.CommandContext(ctx, name, arg...)
+	} else {
+		sdArgs := []string{"--scope", "--quiet", "--collect"}
+		if l.MemoryMB > 0 {
+			sdArgs = append(sdArgs, "-p", fmt.Sprintf("MemoryMax=%dM", l.MemoryMB))
+		}
+		if l.CPUPercent > 0 {
+			sdArgs = append(sdArgs, "-p", fmt.Sprintf("CPUQuota=%d%%", l.CPUPercent))
+		}
+		sdArgs = append(sdArgs, "--", name)
+		sdArgs = append(sdArgs, arg...)
+
+		cmd = exec.CommandContext(ctx, "systemd-run", sdArgs...)
+	}
+
+	cmd.WaitDelay = waitDelay
+	return cmd
+}
+
+// cappedBuffer is an io.Writer that retains at most limit bytes, silently
+// discarding anything beyond that, so a flood of output from a confined
+// qemu-img process cannot exhaust memory.
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	limit int64
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if remaining := c.limit - int64(c.buf.Len()); remaining > 0 {
+		if int64(len(p)) > remaining {
+			c.buf.Write(p[:remaining])
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func run(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	l := currentLimits()
+	cmd := buildCommand(ctx, l, name, arg)
+
+	stdout := cappedBuffer{limit: maxOutputBytes(l)}
+	stderr := cappedBuffer{limit: maxOutputBytes(l)}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return stdout.buf.Bytes(), fmt.Errorf(
 			"Command %v failed rc=%v: out=%q err=%q",
 			cmd.Args,
 			cmd.ProcessState.ExitCode(),
-			stdout,
-			stderr,
+			stdout.buf.Bytes(),
+			stderr.buf.Bytes(),
 		)
 	}
 
-	return stdout, nil
+	return stdout.buf.Bytes(), nil
+}
+
+// runStreaming runs name with arg like run, but scans its stdout for
+// qemu-img -p progress reports as it runs, sending a Progress on progress
+// for each one (total is used to translate a percentage into
+// BytesDone/BytesTotal). progress may be nil, in which case output is
+// still collected but no updates are sent. ctx may be used to cancel the
+// command; a canceled ctx also aborts a pending send on progress.
+func runStreaming(ctx context.Context, progress chan<- Progress, total uint64, name string, arg ...string) ([]byte, error) {
+	l := currentLimits()
+	cmd := buildCommand(ctx, l, name, arg)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr := cappedBuffer{limit: maxOutputBytes(l)}
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	out := cappedBuffer{limit: maxOutputBytes(l)}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		out.Write([]byte(line))
+
+		if m := progressRe.FindStringSubmatch(line); m != nil && progress != nil {
+			percent, perr := strconv.ParseFloat(m[1], 64)
+			if perr == nil {
+				select {
+				case progress <- Progress{
+					Percent:    percent,
+					BytesDone:  uint64(percent / 100 * float64(total)),
+					BytesTotal: total,
+				}:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}
+
+	if serr := scanner.Err(); serr != nil {
+		// The scanner stopped before stdout hit EOF (e.g. a line past
+		// bufio.MaxScanTokenSize). Drain whatever is left so qemu-img
+		// doesn't block writing to a pipe nobody is reading from, then
+		// fail loudly instead of reporting a silently-truncated run.
+		io.Copy(io.Discard, stdout)
+		cmd.Wait()
+		return out.buf.Bytes(), fmt.Errorf("qemuimg: reading output of %v: %v", cmd.Args, serr)
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		return out.buf.Bytes(), fmt.Errorf(
+			"Command %v failed rc=%v: out=%q err=%q",
+			cmd.Args,
+			cmd.ProcessState.ExitCode(),
+			out.buf.Bytes(),
+			stderr.buf.Bytes(),
+		)
+	}
+
+	return out.buf.Bytes(), nil
+}
+
+// scanProgressLines splits on "\n", and also on "\r", which is how
+// qemu-img -p redraws its progress report in-place on a terminal. Unlike
+// bufio.ScanLines it does not treat "\r\n" as a single separator: such a
+// pair yields an extra empty token.
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	for i, b := range data {
+		if b == '\n' || b == '\r' {
+			return i + 1, data[:i], nil
+		}
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
 }
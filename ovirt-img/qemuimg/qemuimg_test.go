@@ -0,0 +1,151 @@
+// ovirt-imageio
+// Copyright (C) 2021 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qemuimg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess is not a real test; go test runs it like any other
+// Test* function, but it only does something when re-exec'd as a child
+// via helperCommand, standing in for qemu-img so the tests below don't
+// depend on a real qemu-img binary being installed.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	args = args[1:]
+
+	switch args[0] {
+	case "progress":
+		fmt.Print("    (1.00/100%)\r")
+		fmt.Print("    (50.00/100%)\r")
+		fmt.Print("    (100.00/100%)\n")
+	case "oversized-line":
+		os.Stdout.Write(make([]byte, bufio.MaxScanTokenSize+1))
+	}
+}
+
+// helperCommand returns a "name, arg..." pair that re-execs the test
+// binary into TestHelperProcess running as mode. The caller must set
+// GO_WANT_HELPER_PROCESS=1 in its own environment before starting the
+// command, since runStreaming's child inherits the test process's env.
+func helperCommand(mode string) (string, []string) {
+	return os.Args[0], []string{"-test.run=TestHelperProcess", "--", mode}
+}
+
+func TestScanProgressLines(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"newline separated", "a\nb\nc\n", []string{"a", "b", "c"}},
+		{"carriage return separated", "a\rb\rc\r", []string{"a", "b", "c"}},
+		{"mixed", "a\rb\nc", []string{"a", "b", "c"}},
+		{"no trailing separator", "a\nb", []string{"a", "b"}},
+		{"empty", "", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scanner := bufio.NewScanner(strings.NewReader(c.input))
+			scanner.Split(scanProgressLines)
+
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatalf("unexpected scan error: %v", err)
+			}
+
+			if len(got) != len(c.want) {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("got %q, want %q", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestScanProgressLinesOversizedToken(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader(strings.Repeat("a", bufio.MaxScanTokenSize+1)))
+	scanner.Split(scanProgressLines)
+
+	for scanner.Scan() {
+	}
+	if scanner.Err() == nil {
+		t.Fatal("expected bufio.ErrTooLong for an oversized token, got nil")
+	}
+}
+
+func TestRunStreamingReportsProgress(t *testing.T) {
+	os.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	defer os.Unsetenv("GO_WANT_HELPER_PROCESS")
+	name, arg := helperCommand("progress")
+
+	progress := make(chan Progress, 8)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := runStreaming(ctx, progress, 1000, name, arg...); err != nil {
+		t.Fatalf("runStreaming: %v", err)
+	}
+	close(progress)
+
+	var last Progress
+	var n int
+	for p := range progress {
+		last = p
+		n++
+	}
+	if n == 0 {
+		t.Fatal("expected at least one progress update")
+	}
+	if last.Percent != 100 || last.BytesTotal != 1000 || last.BytesDone != 1000 {
+		t.Fatalf("unexpected final progress: %+v", last)
+	}
+}
+
+func TestRunStreamingOversizedLineFailsLoudly(t *testing.T) {
+	os.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	defer os.Unsetenv("GO_WANT_HELPER_PROCESS")
+	name, arg := helperCommand("oversized-line")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := runStreaming(ctx, nil, 0, name, arg...)
+	if err == nil {
+		t.Fatal("expected an error for a progress line exceeding bufio.MaxScanTokenSize, got nil")
+	}
+}
+
+func TestBuildCommandSetsWaitDelay(t *testing.T) {
+	cmd := buildCommand(context.Background(), Limits{}, "qemu-img", []string{"info"})
+	if cmd.WaitDelay == 0 {
+		t.Fatal("buildCommand did not set WaitDelay; a child process inheriting the output pipes could hang Wait() indefinitely")
+	}
+}
@@ -0,0 +1,54 @@
+// ovirt-imageio
+// Copyright (C) 2021 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qemuimg
+
+import "testing"
+
+func TestValidatePath(t *testing.T) {
+	cases := []struct {
+		name          string
+		path          string
+		allowProtocol bool
+		wantErr       bool
+	}{
+		{name: "plain path", path: "/var/tmp/disk.img"},
+		{name: "leading dash", path: "-rf", wantErr: true},
+		{name: "protocol string rejected by default", path: "nbd://host/export", wantErr: true},
+		{name: "protocol string allowed when opted in", path: "nbd://host/export", allowProtocol: true},
+		{name: "leading dash still rejected when protocol allowed", path: "-rf", allowProtocol: true, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validatePath(c.path, c.allowProtocol)
+			if c.wantErr && err == nil {
+				t.Fatalf("validatePath(%q, %v) = nil, want error", c.path, c.allowProtocol)
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("validatePath(%q, %v) = %v, want nil", c.path, c.allowProtocol, err)
+			}
+		})
+	}
+}
+
+func TestEscapeOptValue(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"/var/tmp/base.qcow2", "/var/tmp/base.qcow2"},
+		{"/var/tmp/base,subformat=evil.qcow2", "/var/tmp/base,,subformat=evil.qcow2"},
+		{"a,,b", "a,,,,b"},
+	}
+
+	for _, c := range cases {
+		if got := escapeOptValue(c.in); got != c.want {
+			t.Errorf("escapeOptValue(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}